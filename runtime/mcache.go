@@ -4,7 +4,10 @@
 
 package runtime
 
-import "unsafe"
+import (
+	"runtime/internal/atomic"
+	"unsafe"
+)
 
 // Per-thread (in Go, per-P) cache for small objects.
 // No locking needed because it is per-thread (per-P).
@@ -17,7 +20,7 @@ type mcache struct {
 	// The following members are accessed on every malloc,
 	// so they are grouped here for better caching.
 	next_sample int32   // trigger heap sample after allocating this many bytes
-	local_scan  uintptr // bytes of scannable heap allocated
+	scanAlloc   uintptr // bytes of scannable heap allocated since last flush, 距上次flush以来分配的可扫描堆字节数
 
 	// Allocator cache for tiny objects w/o pointers.
 	// See "Tiny allocator" comment in malloc.go.
@@ -28,9 +31,9 @@ type mcache struct {
 	// tiny is a heap pointer. Since mcache is in non-GC'd memory,
 	// we handle it by clearing it in releaseAll during mark
 	// termination.
-	tiny             uintptr // 16字节tiny的内存指针
-	tinyoffset       uintptr // 已经使用到的内存地址便宜
-	local_tinyallocs uintptr // 通过tiny分配内存的次数 number of tiny allocs not counted in other stats
+	tiny       uintptr // 16字节tiny的内存指针
+	tinyoffset uintptr // 已经使用到的内存地址便宜
+	tinyAllocs uintptr // 距上次flush以来通过tiny分配内存的次数 number of tiny allocs not counted in other stats
 
 	// The rest is not accessed on every malloc.
 
@@ -38,11 +41,20 @@ type mcache struct {
 
 	stackcache [_NumStackOrders]stackfreelist
 
+	// flushGen indicates the sweepgen during which this mcache
+	// was last flushed. If flushGen != mheap_.sweepgen, then this P's
+	// mcache has not yet flushed its refill/alloc for this sweep cycle.
+	// 这个mcache上次被releaseAll冲刷时的sweepgen
+	flushGen uint32
+
 	// Local allocator stats, flushed during GC.
 	local_nlookup    uintptr                  // number of pointer lookups
 	local_largefree  uintptr                  // bytes freed for large objects (>maxsmallsize)
 	local_nlargefree uintptr                  // number of frees for large objects (>maxsmallsize)
 	local_nsmallfree [_NumSizeClasses]uintptr // 小对象(<=maxsmallsize 32KB)里面返还给mheap或者mcentral的未被使用的object的历史总和，但是当pprof获取堆信息的时候会被清0 // number of frees for small objects (<=maxsmallsize)
+
+	// heapStats汇总了allocLarge/nextFree这些路径的分配增量，由donate统一冲刷
+	heapStats heapStatsDelta
 }
 
 // A gclink is a node in a linked list of blocks, like mlink,
@@ -74,14 +86,64 @@ type stackfreelist struct {
 // dummy MSpan that contains no free objects.
 var emptymspan mspan
 
-func allocmcache() *mcache {
+// mcacheAllocator abstracts where an mcache's own backing memory comes
+// from. The default implementation still draws from mheap_.cachealloc,
+// but an experimental subsystem (e.g. a per-goroutine region/arena
+// allocator) can supply its own implementation and reuse refill,
+// releaseAll, and the stackcache machinery unmodified.
+// mcache底层内存来源的抽象，默认走mheap_.cachealloc
+type mcacheAllocator interface {
+	alloc() unsafe.Pointer
+	free(p unsafe.Pointer)
+}
+
+// heapCacheAllocator is the default mcacheAllocator, backed by
+// mheap_.cachealloc. Unlike the combined critical section this replaces
+// (mheap_.lock held across both purgecachedstats and cachealloc.free in
+// freemcache), alloc and free each take mheap_.lock independently.
+// mcacheAllocator的默认实现，加锁粒度按alloc/free拆开了
+type heapCacheAllocator struct{}
+
+func (heapCacheAllocator) alloc() unsafe.Pointer {
+	lock(&mheap_.lock)
+	p := mheap_.cachealloc.alloc()
+	unlock(&mheap_.lock)
+	return p
+}
+
+func (heapCacheAllocator) free(p unsafe.Pointer) {
 	lock(&mheap_.lock)
-	c := (*mcache)(mheap_.cachealloc.alloc())
+	mheap_.cachealloc.free(p)
 	unlock(&mheap_.lock)
+}
+
+// mcacheAlloc is the mcacheAllocator currently in effect, defaulting to
+// heapCacheAllocator. An experimental subsystem built with the
+// goexperiment.arenas tag can swap it out via SetMcacheAllocator, but
+// only before mcacheAllocStarted is observed set: once any P has
+// allocated its mcache through it, further writes would race with
+// unsynchronized reads from allocmcache/freemcache on other Ps.
+// 当前生效的mcacheAllocator；只能在第一个mcache分配之前替换
+var mcacheAlloc mcacheAllocator = heapCacheAllocator{}
+
+// mcacheAllocStarted is set the first time allocmcache reads mcacheAlloc,
+// so SetMcacheAllocator can refuse a too-late swap instead of racing with
+// concurrent, unsynchronized reads of mcacheAlloc from other Ps.
+// 第一次读取mcacheAlloc后置位，阻止SetMcacheAllocator太晚替换导致的数据竞争
+var mcacheAllocStarted uint32
+
+func allocmcache() *mcache {
+	atomic.Store(&mcacheAllocStarted, 1)
+	c := (*mcache)(mcacheAlloc.alloc())
 	for i := range c.alloc {
 		c.alloc[i] = &emptymspan
 	}
 	c.next_sample = nextSample()
+	// A freshly allocated mcache has no cached spans, so align flushGen to
+	// the current sweepgen to avoid a pointless releaseAll the first time
+	// prepareForSweep runs for this P.
+	// 新mcache没有span，直接对齐flushGen，避免第一次prepareForSweep空跑
+	c.flushGen = mheap_.sweepgen
 	return c
 }
 
@@ -91,6 +153,11 @@ func freemcache(c *mcache) {
 		c.releaseAll()
 		stackcache_clear(c)
 
+		// Flush any scanAlloc/tinyAllocs/heapStats deltas accumulated
+		// since the last refill so they aren't lost when c is freed below.
+		// 回收前先把没flush过的统计增量冲刷掉，不然就随c一起丢了
+		c.donate()
+
 		// NOTE(rsc,rlh): If gcworkbuffree comes back, we need to coordinate
 		// with the stealing of gcworkbufs during garbage collection to avoid
 		// a race where the workbuf is double-freed.
@@ -98,8 +165,8 @@ func freemcache(c *mcache) {
 
 		lock(&mheap_.lock)
 		purgecachedstats(c)
-		mheap_.cachealloc.free(unsafe.Pointer(c))
 		unlock(&mheap_.lock)
+		mcacheAlloc.free(unsafe.Pointer(c))
 	})
 }
 
@@ -116,9 +183,14 @@ func (c *mcache) refill(spc spanClass) *mspan {
 	if uintptr(s.allocCount) != s.nelems {
 		throw("refill of span with free space remaining")
 	}
-	// 取消正在使用标记
+	// Mark the span as no longer cached by CASing its sweepgen back from
+	// "swept, in cache" to "needs sweeping", instead of flipping a plain
+	// bool.
+	// 不再用incache这个bool，改用CAS把sweepgen切回"待清扫"
 	if s != &emptymspan {
-		s.incache = false
+		if !atomic.Cas(&s.sweepgen, mheap_.sweepgen, mheap_.sweepgen-1) {
+			throw("bad sweepgen in refill")
+		}
 	}
 
 	// Get a new cached span from the central lists.
@@ -132,11 +204,185 @@ func (c *mcache) refill(spc spanClass) *mspan {
 		throw("span has no free space")
 	}
 
+	// CAS the incoming span's sweepgen from "needs sweeping, in cache" to
+	// "swept, in cache".
+	// 新span的sweepgen切到"已清扫、在cache里"
+	if !atomic.Cas(&s.sweepgen, mheap_.sweepgen-1, mheap_.sweepgen) {
+		throw("bad sweepgen in refill")
+	}
+
 	c.alloc[spc] = s // mheap的central里分配一个span替换了mcache里的span
 	_g_.m.locks--
+
+	// Refilling a span is a natural flush point: fold this refill
+	// period's stat deltas into memstats here too, instead of waiting
+	// solely on GC to flush them.
+	// 换span顺带把这轮统计增量冲刷到memstats
+	c.donate()
+
 	return s
 }
 
+// heapStatsDelta aggregates the heap stats a single P accumulates between
+// flushes, across the large- and small-object allocator paths. The hot
+// scanAlloc/tinyAllocs counters stay as their own mcache fields, grouped
+// up top for cache locality on every malloc; heapStatsDelta covers the
+// rest (allocLarge and nextFree populate it directly), so all of it
+// still flushes into memstats through donate.
+// 聚合per-P分配增量(大/小对象)，由donate统一flush进全局memstats的结构体
+type heapStatsDelta struct {
+	committed       int64                  // byte delta of memory committed
+	inHeap          int64                  // byte delta of memory placed in the heap
+	largeAlloc      int64                  // bytes of large objects allocated
+	largeAllocCount int64                  // number of large objects allocated
+	smallAllocCount [_NumSizeClasses]int64 // number of small objects allocated, by size class
+}
+
+// donate atomically folds this mcache's unreported stat deltas, both the
+// hot scanAlloc/tinyAllocs fields and c.heapStats, into the global
+// memstats. Called both at GC mark termination and from refill.
+// 把mcache里未flush的统计增量灌入全局memstats
+func (c *mcache) donate() {
+	if c.scanAlloc != 0 {
+		atomic.Xadd64(&memstats.heapStats.scanAlloc, int64(c.scanAlloc))
+		c.scanAlloc = 0
+	}
+	if c.tinyAllocs != 0 {
+		atomic.Xadd64(&memstats.heapStats.tinyAllocCount, int64(c.tinyAllocs))
+		c.tinyAllocs = 0
+	}
+
+	hs := &c.heapStats
+	if hs.committed != 0 {
+		atomic.Xadd64(&memstats.heapStats.committed, hs.committed)
+		hs.committed = 0
+	}
+	if hs.inHeap != 0 {
+		atomic.Xadd64(&memstats.heapStats.inHeap, hs.inHeap)
+		hs.inHeap = 0
+	}
+	if hs.largeAlloc != 0 {
+		atomic.Xadd64(&memstats.heapStats.largeAlloc, hs.largeAlloc)
+		hs.largeAlloc = 0
+	}
+	if hs.largeAllocCount != 0 {
+		atomic.Xadd64(&memstats.heapStats.largeAllocCount, hs.largeAllocCount)
+		hs.largeAllocCount = 0
+	}
+	for i, n := range hs.smallAllocCount {
+		if n != 0 {
+			atomic.Xadd64(&memstats.heapStats.smallAllocCount[i], n)
+			hs.smallAllocCount[i] = 0
+		}
+	}
+}
+
+// prepareForSweep flushes c if the system has entered a new sweep phase
+// since c was populated. This must happen between the sweep phase
+// starting and this P's first allocation in that phase.
+// 新一轮清扫开始、分配前调用，把上一轮还没归还的span释放掉
+func (c *mcache) prepareForSweep() {
+	sg := mheap_.sweepgen
+	if c.flushGen == sg {
+		return
+	}
+	c.releaseAll()
+	c.flushGen = sg
+}
+
+// allocLarge allocates a span for an object larger than maxSmallSize. It
+// goes straight to mheap_, bypassing mcentral entirely: a large object's
+// span will only ever hold that one element, so there is nothing worth
+// caching. The small-size-class path continues to use refill.
+// 大对象(超过32KB)直接向mheap申请专属span，跳过mcentral
+func (c *mcache) allocLarge(size uintptr, needzero bool, noscan bool) *mspan {
+	if size+_PageSize < size {
+		throw("out of memory")
+	}
+	npages := size >> _PageShift
+	if size&_PageMask != 0 {
+		npages++
+	}
+
+	s := mheap_.alloc(npages, makeSpanClass(0, noscan), needzero)
+	if s == nil {
+		throw("out of memory")
+	}
+
+	// Make s look like it has been handed out in full; the existing
+	// local_largefree/local_nlargefree bookkeeping still applies to it
+	// unchanged whenever this span is eventually freed.
+	s.limit = s.base() + size
+	s.freeindex = 0
+	s.allocCount = 1
+
+	// Feed heapStatsDelta so large allocations aren't invisible to per-P stats.
+	// 大对象分配也计入heapStatsDelta
+	c.heapStats.largeAlloc += int64(npages) * _PageSize
+	c.heapStats.largeAllocCount++
+
+	return s
+}
+
+// nextFree returns a free object from the cached span for spc, refilling
+// from mcentral if that span is exhausted. shouldhelpgc indicates that
+// the caller should consider assisting the GC.
+// 从spc对应的缓存span取一个空闲对象，用完则refill
+func (c *mcache) nextFree(spc spanClass) (v gclinkptr, s *mspan, shouldhelpgc bool) {
+	s = c.alloc[spc]
+	freeIndex := s.nextFreeIndex()
+	if freeIndex == s.nelems {
+		// The span is full.
+		if uintptr(s.allocCount) != s.nelems {
+			throw("s.allocCount != s.nelems && freeIndex == s.nelems")
+		}
+		c.refill(spc)
+		shouldhelpgc = true
+		s = c.alloc[spc]
+
+		freeIndex = s.nextFreeIndex()
+	}
+
+	if freeIndex >= s.nelems {
+		throw("freeIndex is not valid")
+	}
+
+	v = gclinkptr(freeIndex*s.elemsize + s.base())
+	s.allocCount++
+	if uintptr(s.allocCount) > s.nelems {
+		throw("s.allocCount > s.nelems")
+	}
+	c.heapStats.smallAllocCount[spc.sizeclass()]++
+	return
+}
+
+// tinyAlloc encapsulates the tiny allocator's sub-16-byte block rounding
+// and offset bookkeeping. It returns nil when the current tiny block
+// cannot satisfy this request, leaving it to the caller to acquire a
+// new tiny block.
+// tiny分配器的对齐/偏移计算
+func (c *mcache) tinyAlloc(size, align uintptr) unsafe.Pointer {
+	off := c.tinyoffset
+	// Align tiny pointer for required (conservative) alignment.
+	if align&7 == 0 {
+		off = alignUp(off, 8)
+	} else if align&3 == 0 {
+		off = alignUp(off, 4)
+	} else if align&1 == 0 {
+		off = alignUp(off, 2)
+	}
+	if off+size <= maxTinySize && c.tiny != 0 {
+		x := unsafe.Pointer(c.tiny + off)
+		c.tinyoffset = off + size
+		// Count every successful tiny fit, not just new-block
+		// acquisitions, so heap profile sampling sees each tiny object.
+		// 每次成功的tiny fit都计数，不止新块获取时
+		c.tinyAllocs++
+		return x
+	}
+	return nil
+}
+
 func (c *mcache) releaseAll() {
 	for i := range c.alloc {
 		s := c.alloc[i]
@@ -0,0 +1,24 @@
+// Copyright 2009 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build goexperiment.arenas
+
+package runtime
+
+import "runtime/internal/atomic"
+
+// SetMcacheAllocator lets an experimental region/arena subsystem take
+// over the backing allocation for mcache itself, so it can reuse
+// refill, releaseAll, and the stackcache machinery without forking the
+// runtime. It must be called before any P has allocated an mcache
+// (e.g. during runtime bootstrap); it throws otherwise, since swapping
+// mcacheAlloc afterward would race with unsynchronized reads of it from
+// other Ps. Only built when the goexperiment.arenas tag is enabled.
+// 只能在第一个mcache分配之前调用，否则会和其它P对mcacheAlloc的读产生数据竞争
+func SetMcacheAllocator(a mcacheAllocator) {
+	if atomic.Load(&mcacheAllocStarted) != 0 {
+		throw("SetMcacheAllocator called after an mcache was already allocated")
+	}
+	mcacheAlloc = a
+}